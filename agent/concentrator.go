@@ -5,7 +5,9 @@
 package main
 
 import (
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -13,17 +15,48 @@ import (
 	"github.com/DataDog/raclette/model"
 )
 
+// maxFlushJitter bounds the random jitter added to each flush tick, to avoid
+// every agent in a fleet hammering the writer at the exact same instant.
+const maxFlushJitter = 100 * time.Millisecond
+
+// tdigestCompression is the delta passed to every TDigest a Concentrator
+// keeps when run with AlgoTDigest.
+const tdigestCompression = 100
+
+// maxGKEps is passed to model.NewStatsBucket instead of the configured eps
+// when AlgoTDigest is selected: the GK sketch's own quantiles go unread in
+// that mode, so we ask for the coarsest (cheapest) one it supports rather
+// than pay for a second full quantile structure.
+const maxGKEps = 1.0
+
+// QuantileAlgo selects the summary structure used for distribution stats
+// (span durations, etc).
+type QuantileAlgo int
+
+const (
+	// AlgoGK is the GK-style quantile summary model.StatsBucket has always used.
+	AlgoGK QuantileAlgo = iota
+	// AlgoTDigest keeps a mergeable t-digest per (service,resource) alongside
+	// it: more accurate in the tails at fixed memory, and unlike the GK
+	// sketch it can be merged losslessly across agents.
+	AlgoTDigest
+)
+
 // Concentrator is getting a stream of raw traces and producing some time-bucketed normalized statistics from them.
 //  * inSpans, channel from which we consume spans and create stats
-//  * outStats, channel where we return our computed stats
+//  * exporter, sink flushed buckets are reported to
 //	* bucketDuration, designates the length of a time bucket
-//	* openBucket, array of stats buckets we keep in memory (fixed size and iterating over)
-//  * currentBucket, the index of openBucket we're currently writing to
+//  * buckets, ring of stats buckets we keep in memory, indexed by ring slot (bucketStarts maps each slot to its aligned bucket start)
+//  * currentBucket, the ring index currently open for writes
+//  * numShards workers each own one sub-bucket per ring slot, sharded by TraceID,
+//    so HandleNewSpan never contends on a single lock
 type Concentrator struct {
 	// work channels
-	inSpans  chan model.Span        // incoming spans to add to stats
-	outStats chan model.StatsBucket // outgoing stats buckets
-	outSpans chan model.Span        // spans that potentially need to be written with that time bucket
+	inSpans  chan model.Span // incoming spans to add to stats
+	outSpans chan model.Span // spans that potentially need to be written with that time bucket
+
+	// where flushed buckets go
+	exporter StatsExporter
 
 	// exit channels
 	exit      chan bool
@@ -32,33 +65,108 @@ type Concentrator struct {
 	// configuration
 	bucketDuration int
 	eps            float64
+	numBuckets     int
+	numShards      int
+	lateSpanGrace  int64 // seconds a span may arrive late and still land in its proper bucket
+	quantileAlgo   QuantileAlgo
+
+	// sharding: one worker and one channel per shard, hashed by TraceID
+	shardChans []chan model.Span
+	rotate     []chan struct{}
+	rotateAck  []chan struct{}
+	resume     []chan struct{}
 
 	// internal data structs
-	openBucket    [2]*model.StatsBucket
-	currentBucket int32
+	buckets       [][]*model.StatsBucket // buckets[ring][shard]
+	bucketStarts  []int64                // aligned wall-clock start owned by ring slot i, accessed atomically
+	currentBucket int32                  // ring index currently open for writes, accessed atomically
+
+	// digests holds, per ring slot and per shard, one TDigest per
+	// "service|resource" key: digests[ring][shard]. Each shard worker is the
+	// sole writer of its own slice, same as buckets, so no lock is needed on
+	// the hot path; only populated when quantileAlgo is AlgoTDigest.
+	digests [][]map[string]*TDigest
+
+	// lastDigests is the most recently flushed ring slot's digests, queryable
+	// through Percentile once the GK sketch's bucket has already moved on.
+	lastDigestsMu sync.RWMutex
+	lastDigests   map[string]*TDigest
 }
 
-// NewConcentrator returns a new Concentrator flushing at a bucketDuration secondspace
-func NewConcentrator(bucketDuration int, eps float64, exit chan bool, exitGroup *sync.WaitGroup) *Concentrator {
+// NewConcentrator returns a new Concentrator flushing at a bucketDuration seconds
+// cadence, keeping numBuckets buckets in its ring so spans up to lateSpanGrace
+// seconds late can still land in the bucket they belong to, sharding incoming
+// spans across numShards workers hashed by TraceID, and summarizing span
+// durations with quantileAlgo.
+func NewConcentrator(bucketDuration int, eps float64, numBuckets int, numShards int, lateSpanGrace int, quantileAlgo QuantileAlgo, exit chan bool, exitGroup *sync.WaitGroup) *Concentrator {
+	if numBuckets < 1 {
+		numBuckets = 1
+	}
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	buckets := make([][]*model.StatsBucket, numBuckets)
+	digests := make([][]map[string]*TDigest, numBuckets)
+	for i := range buckets {
+		buckets[i] = make([]*model.StatsBucket, numShards)
+		digests[i] = make([]map[string]*TDigest, numShards)
+		for j := range digests[i] {
+			digests[i][j] = make(map[string]*TDigest)
+		}
+	}
+
+	shardChans := make([]chan model.Span, numShards)
+	rotate := make([]chan struct{}, numShards)
+	rotateAck := make([]chan struct{}, numShards)
+	resume := make([]chan struct{}, numShards)
+	for i := 0; i < numShards; i++ {
+		shardChans[i] = make(chan model.Span, 1000)
+		rotate[i] = make(chan struct{})
+		rotateAck[i] = make(chan struct{})
+		resume[i] = make(chan struct{})
+	}
+
 	return &Concentrator{
 		bucketDuration: bucketDuration,
 		eps:            eps,
+		numBuckets:     numBuckets,
+		numShards:      numShards,
+		lateSpanGrace:  int64(lateSpanGrace),
+		quantileAlgo:   quantileAlgo,
 		exit:           exit,
 		exitGroup:      exitGroup,
+		shardChans:     shardChans,
+		rotate:         rotate,
+		rotateAck:      rotateAck,
+		resume:         resume,
+		buckets:        buckets,
+		bucketStarts:   make([]int64, numBuckets),
+		digests:        digests,
+		exporter:       NullExporter{},
 	}
 }
 
-// Init sets the channels for incoming spans and outgoing stats before starting
-func (c *Concentrator) Init(inSpans chan model.Span, outStats chan model.StatsBucket, outSpans chan model.Span) {
+// Init sets the channel for incoming spans, the channel for spans that need
+// writing, and the exporter flushed stats buckets are reported to.
+func (c *Concentrator) Init(inSpans chan model.Span, outSpans chan model.Span, exporter StatsExporter) {
 	c.inSpans = inSpans
-	c.outStats = outStats
 	c.outSpans = outSpans
+	c.exporter = exporter
 }
 
 // Start initializes the first structures and starts consuming stuff
 func (c *Concentrator) Start() {
-	// First bucket needs to be initialized manually now
-	c.openBucket[0] = model.NewStatsBucket(c.eps)
+	// First ring slot needs to be initialized manually now
+	aligned := c.alignedNow()
+	for i := 0; i < c.numShards; i++ {
+		c.buckets[0][i] = c.newBucket(aligned)
+	}
+	c.bucketStarts[0] = aligned
+
+	for i := 0; i < c.numShards; i++ {
+		go c.shardWorker(i)
+	}
 
 	go func() {
 		// should return when upstream span channel is closed
@@ -66,6 +174,9 @@ func (c *Concentrator) Start() {
 			c.HandleNewSpan(&s)
 			c.outSpans <- s
 		}
+		for i := 0; i < c.numShards; i++ {
+			close(c.shardChans[i])
+		}
 	}()
 
 	go c.bucketCloser()
@@ -73,36 +184,280 @@ func (c *Concentrator) Start() {
 	log.Info("Concentrator started")
 }
 
-// HandleNewSpan adds to the current bucket the pointed span
+// alignedNow returns the current wall-clock time, floored to the nearest
+// multiple of bucketDuration, so that buckets align across a fleet of agents.
+func (c *Concentrator) alignedNow() int64 {
+	d := int64(c.bucketDuration)
+	return (time.Now().Unix() / d) * d
+}
+
+// newBucket creates a StatsBucket for a ring slot and stamps its Start to
+// alignedStart (unix seconds), the wall-clock boundary the slot owns,
+// instead of leaving it at whatever moment model.NewStatsBucket happened to
+// run: that's what actually makes buckets comparable across a fleet, since
+// Start is what gets serialized and shipped, not bucketStarts.
+func (c *Concentrator) newBucket(alignedStart int64) *model.StatsBucket {
+	eps := c.eps
+	if c.quantileAlgo == AlgoTDigest {
+		// the GK sketch's own quantiles go unread in this mode: ask for the
+		// coarsest one it supports instead of paying for a second full
+		// quantile structure alongside the t-digest.
+		eps = maxGKEps
+	}
+	b := model.NewStatsBucket(eps)
+	b.Start = alignedStart * int64(time.Second)
+	return b
+}
+
+// HandleNewSpan dispatches the span to the shard owning its TraceID. That
+// shard's own worker goroutine is the only writer of its sub-bucket, so no
+// locking is needed on the hot path.
 func (c *Concentrator) HandleNewSpan(s *model.Span) {
-	c.openBucket[c.currentBucket].HandleSpan(s)
+	c.shardChans[c.shardFor(s.TraceID)] <- *s
+}
+
+// shardFor hashes a TraceID to one of the numShards workers.
+func (c *Concentrator) shardFor(id model.TraceID) int {
+	return int(uint64(id) % uint64(c.numShards))
+}
+
+// shardWorker owns sub-bucket shard of every ring slot. It's the sole writer
+// of that sub-bucket, and pauses on rotate to let flush() merge it safely
+// when the ring rotates, closing the race the old single-bucket swap had.
+func (c *Concentrator) shardWorker(shard int) {
+	for {
+		select {
+		case s, ok := <-c.shardChans[shard]:
+			if !ok {
+				return
+			}
+			c.handle(shard, &s)
+		case <-c.rotate[shard]:
+			// a span queued ahead of this signal (the very case
+			// lateSpanGrace exists to support) can otherwise still be
+			// sitting in shardChans when we ack: drain it before acking, so
+			// flush() never merges a bucket this shard is still writing to.
+			c.drainShard(shard)
+			c.rotateAck[shard] <- struct{}{}
+
+			// a late span can still arrive and resolve, via lookupRing, to
+			// the ring slot we just acked out of (it isn't reused until the
+			// ring wraps back around): stay paused until flush() confirms
+			// that slot's merge/Encode/send have finished, so a late write
+			// can never race the goroutine reading it.
+			<-c.resume[shard]
+		}
+	}
+}
+
+// drainShard applies every span already buffered on this shard's channel,
+// without blocking for new ones, so a rotate ack always means "nothing left
+// queued for the bucket that's about to be merged."
+func (c *Concentrator) drainShard(shard int) {
+	for {
+		select {
+		case s, ok := <-c.shardChans[shard]:
+			if !ok {
+				return
+			}
+			c.handle(shard, &s)
+		default:
+			return
+		}
+	}
+}
+
+// handle adds s to the ring slot it belongs to, which may be a historical
+// slot if the span arrived up to lateSpanGrace seconds late.
+func (c *Concentrator) handle(shard int, s *model.Span) {
+	current := int(atomic.LoadInt32(&c.currentBucket))
+	idx, ok := c.lookupRing(current, s.Start/int64(time.Second))
+	if !ok {
+		idx = current
+	}
+	c.buckets[idx][shard].HandleSpan(s)
+
+	if c.quantileAlgo == AlgoTDigest {
+		c.digestFor(idx, shard, s.Service, s.Resource).Add(float64(s.Duration))
+	}
 }
 
+// digestFor returns the TDigest tracking (service,resource) in ring slot
+// idx for shard, creating it on first use. shard is this goroutine's own
+// shardWorker index, so no lock is needed: it's the sole writer of
+// c.digests[idx][shard], same as it is for c.buckets[idx][shard].
+func (c *Concentrator) digestFor(idx, shard int, service, resource string) *TDigest {
+	key := service + "|" + resource
+
+	m := c.digests[idx][shard]
+	d, ok := m[key]
+	if !ok {
+		d = NewTDigest(tdigestCompression)
+		m[key] = d
+	}
+	return d
+}
+
+// lookupRing finds the ring slot owning the bucket spanTime (unix seconds)
+// belongs to, given the currently open slot.
+func (c *Concentrator) lookupRing(current int, spanTime int64) (int, bool) {
+	d := int64(c.bucketDuration)
+	aligned := (spanTime / d) * d
+	currentStart := atomic.LoadInt64(&c.bucketStarts[current])
+
+	if aligned == currentStart {
+		return current, true
+	}
+	if aligned > currentStart {
+		// clock skew ahead of us, no bucket for it yet
+		return 0, false
+	}
+	if currentStart-aligned > c.lateSpanGrace {
+		// too old, its bucket is long gone
+		return 0, false
+	}
+	for i := range c.bucketStarts {
+		if i != current && atomic.LoadInt64(&c.bucketStarts[i]) == aligned {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// flush closes the currently open ring slot, opens the next one for writes,
+// merges the closed slot's shards and pushes the result downstream.
 func (c *Concentrator) flush() {
-	nextBucket := (c.currentBucket + 1) % 2
-	c.openBucket[nextBucket] = model.NewStatsBucket(c.eps)
+	closedIdx := int(atomic.LoadInt32(&c.currentBucket))
+	nextIdx := (closedIdx + 1) % c.numBuckets
+
+	// barrier: every shard worker drains spans queued ahead of the swap
+	// before we touch any of its sub-buckets, so neither the reset of the
+	// next ring slot nor the merge below races a write.
+	for i := 0; i < c.numShards; i++ {
+		c.rotate[i] <- struct{}{}
+	}
+	for i := 0; i < c.numShards; i++ {
+		<-c.rotateAck[i]
+	}
+
+	aligned := c.alignedNow()
+	for i := 0; i < c.numShards; i++ {
+		c.buckets[nextIdx][i] = c.newBucket(aligned)
+		if c.quantileAlgo == AlgoTDigest {
+			c.digests[nextIdx][i] = make(map[string]*TDigest)
+		}
+	}
+	atomic.StoreInt64(&c.bucketStarts[nextIdx], aligned)
+	atomic.StoreInt32(&c.currentBucket, int32(nextIdx))
+
+	merged := c.mergeShards(closedIdx)
+	merged.Encode()
+	c.send(merged)
+
+	if c.quantileAlgo == AlgoTDigest {
+		c.publishDigests(closedIdx)
+	}
+
+	// only now is closedIdx fully read: let every shard resume, so a late
+	// span can safely route back into it again if lookupRing still allows it.
+	for i := 0; i < c.numShards; i++ {
+		c.resume[i] <- struct{}{}
+	}
+}
 
-	//FIXME: use a mutex? too slow? don't care about potential traces written to previous bucket?
-	// Use it and close the previous one
-	c.openBucket[c.currentBucket].Duration = model.Now() - c.openBucket[c.currentBucket].Start
-	c.currentBucket = nextBucket
+// mergeDigests folds every shard's TDigests for a closed ring slot into one
+// TDigest per (service,resource) key, the same shard-merge chunk0-3 does for
+// model.StatsBucket, via TDigest's own Merge.
+func (c *Concentrator) mergeDigests(ring int) map[string]*TDigest {
+	merged := make(map[string]*TDigest)
+	for shard := 0; shard < c.numShards; shard++ {
+		for key, d := range c.digests[ring][shard] {
+			if existing, ok := merged[key]; ok {
+				existing.Merge(d)
+			} else {
+				merged[key] = d
+			}
+		}
+	}
+	return merged
+}
+
+// publishDigests merges the closed ring slot's per-shard digests, makes the
+// result available through Percentile once the GK bucket they mirror has
+// already moved on, and hands each key's centroids to the exporter when it
+// implements DigestExporter, so they actually leave the process.
+func (c *Concentrator) publishDigests(ring int) {
+	merged := c.mergeDigests(ring)
+
+	c.lastDigestsMu.Lock()
+	c.lastDigests = merged
+	c.lastDigestsMu.Unlock()
+
+	de, ok := c.exporter.(DigestExporter)
+	if !ok {
+		return
+	}
+	for key, d := range merged {
+		if err := de.ReportDigest(key, d.Centroids()); err != nil {
+			log.Errorf("Concentrator: exporter failed to report digest for %s: %v", key, err)
+		}
+	}
+}
+
+// DigestExporter is implemented by StatsExporter sinks that can also accept
+// raw t-digest centroids, so a downstream collector can merge distributions
+// across agents instead of only ever seeing the local GK-sketch quantiles
+// baked into a model.StatsBucket. Optional: a Concentrator only calls it
+// when quantileAlgo is AlgoTDigest and the configured exporter implements it.
+type DigestExporter interface {
+	ReportDigest(key string, centroids []Centroid) error
+}
 
-	// flush the other bucket before
-	bucketToSend := (c.currentBucket + 1) % 2
-	if c.openBucket[bucketToSend] != nil {
-		// prepare for serialization
-		c.openBucket[bucketToSend].Encode()
-		c.outStats <- *c.openBucket[bucketToSend]
+// Percentile returns the qth quantile of span durations for (service,
+// resource) from the most recently flushed bucket, when quantileAlgo is
+// AlgoTDigest.
+func (c *Concentrator) Percentile(service, resource string, q float64) (float64, bool) {
+	c.lastDigestsMu.RLock()
+	defer c.lastDigestsMu.RUnlock()
+
+	d, ok := c.lastDigests[service+"|"+resource]
+	if !ok {
+		return 0, false
+	}
+	return d.Quantile(q), true
+}
+
+// mergeShards folds every shard sub-bucket of a closed ring slot into the
+// first one, which becomes the bucket handed downstream.
+func (c *Concentrator) mergeShards(ring int) *model.StatsBucket {
+	merged := c.buckets[ring][0]
+	for i := 1; i < c.numShards; i++ {
+		merged.Merge(c.buckets[ring][i])
+	}
+	merged.Duration = model.Now() - merged.Start
+	return merged
+}
+
+// send reports a flushed bucket to the configured exporter.
+func (c *Concentrator) send(bucket *model.StatsBucket) {
+	if err := c.exporter.Report(*bucket); err != nil {
+		log.Errorf("Concentrator: exporter failed to report stats bucket: %v", err)
 	}
 }
 
+// bucketCloser ticks at a bucketDuration cadence, aligned to wall-clock
+// multiples of bucketDuration and jittered to spread flushes across a fleet.
 func (c *Concentrator) bucketCloser() {
 	// block on the closer, to flush cleanly last bucket
 	c.exitGroup.Add(1)
-	ticker := time.Tick(time.Duration(c.bucketDuration) * time.Second)
+
 	for {
+		wait := c.nextTick()
+		timer := time.NewTimer(wait)
+
 		select {
 		case <-c.exit:
+			timer.Stop()
 			log.Info("Concentrator exiting")
 			// FIXME: don't flush, because downstream the writer is already shutting down
 			// c.flush()
@@ -111,9 +466,18 @@ func (c *Concentrator) bucketCloser() {
 			close(c.outSpans)
 			c.exitGroup.Done()
 			return
-		case <-ticker:
+		case <-timer.C:
 			log.Info("Concentrator flushed a time bucket")
 			c.flush()
 		}
 	}
-}
\ No newline at end of file
+}
+
+// nextTick returns the delay until the next aligned, jittered flush boundary.
+func (c *Concentrator) nextTick() time.Duration {
+	d := time.Duration(c.bucketDuration) * time.Second
+	now := time.Now()
+	next := now.Truncate(d).Add(d)
+	jitter := time.Duration(rand.Int63n(int64(maxFlushJitter)))
+	return next.Add(jitter).Sub(now)
+}
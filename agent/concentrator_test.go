@@ -0,0 +1,248 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/raclette/model"
+)
+
+// newTestConcentrator wires up a Concentrator with enough room downstream
+// that benchmarks never block on the exporter or outSpans.
+func newTestConcentrator(numShards int) *Concentrator {
+	return newTestConcentratorAlgo(numShards, AlgoGK)
+}
+
+// newTestConcentratorAlgo is newTestConcentrator with an explicit
+// QuantileAlgo, for tests that need to observe AlgoTDigest's own bookkeeping.
+func newTestConcentratorAlgo(numShards int, algo QuantileAlgo) *Concentrator {
+	exit := make(chan bool)
+	var exitGroup sync.WaitGroup
+
+	c := NewConcentrator(1, 0.01, 2, numShards, 10, algo, exit, &exitGroup)
+	c.Init(make(chan model.Span), make(chan model.Span, 1000), NullExporter{})
+
+	aligned := c.alignedNow()
+	for i := 0; i < c.numShards; i++ {
+		c.buckets[0][i] = c.newBucket(aligned)
+		go c.shardWorker(i)
+	}
+	c.bucketStarts[0] = aligned
+
+	return c
+}
+
+func benchmarkHandleNewSpan(b *testing.B, numShards int) {
+	c := newTestConcentrator(numShards)
+	now := time.Now().UnixNano()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var traceID model.TraceID
+		for pb.Next() {
+			traceID++
+			c.HandleNewSpan(&model.Span{TraceID: traceID, Start: now})
+		}
+	})
+}
+
+// BenchmarkHandleNewSpanSerial pins everything to a single shard, matching
+// the throughput of the old single-bucket, single-goroutine implementation.
+func BenchmarkHandleNewSpanSerial(b *testing.B) { benchmarkHandleNewSpan(b, 1) }
+
+func BenchmarkHandleNewSpanSharded4(b *testing.B) { benchmarkHandleNewSpan(b, 4) }
+
+func BenchmarkHandleNewSpanSharded8(b *testing.B) { benchmarkHandleNewSpan(b, 8) }
+
+func BenchmarkHandleNewSpanSharded16(b *testing.B) { benchmarkHandleNewSpan(b, 16) }
+
+// TestShardForIsDeterministic checks that every TraceID always hashes to the
+// same shard, which is what lets HandleNewSpan skip locking: a shard's
+// worker must be the only one that ever touches its sub-bucket.
+func TestShardForIsDeterministic(t *testing.T) {
+	c := newTestConcentrator(8)
+	for id := model.TraceID(0); id < 100; id++ {
+		if c.shardFor(id) != c.shardFor(id) {
+			t.Fatalf("shardFor(%d) is not deterministic", id)
+		}
+	}
+}
+
+// TestShardForInRange checks that shardFor never returns an index outside
+// [0, numShards).
+func TestShardForInRange(t *testing.T) {
+	c := newTestConcentrator(4)
+	for id := model.TraceID(0); id < 1000; id++ {
+		shard := c.shardFor(id)
+		if shard < 0 || shard >= c.numShards {
+			t.Fatalf("shardFor(%d) = %d, want [0,%d)", id, shard, c.numShards)
+		}
+	}
+}
+
+// TestLookupRingCurrent checks that a span landing in the currently open
+// bucket is routed there.
+func TestLookupRingCurrent(t *testing.T) {
+	c := newTestConcentrator(1)
+	spanTime := c.bucketStarts[0]
+
+	idx, ok := c.lookupRing(0, spanTime)
+	if !ok || idx != 0 {
+		t.Fatalf("lookupRing = (%d, %v), want (0, true)", idx, ok)
+	}
+}
+
+// TestLookupRingLateSpan checks that a span up to lateSpanGrace seconds
+// behind the current bucket is routed to the historical ring slot still
+// holding its bucket, the case lateSpanGrace exists to support.
+func TestLookupRingLateSpan(t *testing.T) {
+	c := newTestConcentrator(1)
+	current := 0
+	historical := 1
+
+	c.bucketStarts[current] = 20
+	c.bucketStarts[historical] = 10 // within lateSpanGrace (10s) of current
+
+	idx, ok := c.lookupRing(current, 10)
+	if !ok || idx != historical {
+		t.Fatalf("lookupRing = (%d, %v), want (%d, true)", idx, ok, historical)
+	}
+}
+
+// TestLookupRingTooLate checks that lookupRing rejects a span older than
+// lateSpanGrace instead of matching it to a historical ring slot; handle()
+// then counts such a span in the currently open bucket.
+func TestLookupRingTooLate(t *testing.T) {
+	c := newTestConcentrator(1)
+	c.bucketStarts[0] = 100
+
+	if _, ok := c.lookupRing(0, 100-c.lateSpanGrace-1); ok {
+		t.Fatal("expected a span older than lateSpanGrace to be rejected")
+	}
+}
+
+// TestLookupRingFutureSkew checks that a span ahead of the current bucket
+// (clock skew) is rejected rather than matched to a bucket that doesn't
+// exist yet.
+func TestLookupRingFutureSkew(t *testing.T) {
+	c := newTestConcentrator(1)
+	c.bucketStarts[0] = 100
+
+	if _, ok := c.lookupRing(0, 200); ok {
+		t.Fatal("expected a span ahead of the current bucket to be rejected")
+	}
+}
+
+// TestHandleRoutesLateSpanToHistoricalRing checks that handle(), not just
+// lookupRing in isolation, ends up touching the historical ring slot's
+// digest for a late span rather than the currently open one. AlgoTDigest
+// is used here because it's the one piece of this path we can observe
+// directly without a real model.StatsBucket implementation.
+func TestHandleRoutesLateSpanToHistoricalRing(t *testing.T) {
+	c := newTestConcentratorAlgo(1, AlgoTDigest)
+	current := int(c.currentBucket)
+	historical := (current + 1) % c.numBuckets
+
+	c.bucketStarts[historical] = c.bucketStarts[current] - 5 // within grace
+	c.buckets[historical][0] = c.newBucket(c.bucketStarts[historical])
+
+	span := &model.Span{Service: "web", Resource: "/", Start: c.bucketStarts[historical] * int64(time.Second), Duration: 42}
+	c.handle(0, span)
+
+	if _, ok := c.digests[historical][0]["web|/"]; !ok {
+		t.Fatal("expected the late span's digest to land in the historical ring slot")
+	}
+	if _, ok := c.digests[current][0]["web|/"]; ok {
+		t.Fatal("expected the late span's digest not to land in the currently open ring slot")
+	}
+}
+
+// TestShardWorkerStaysPausedUntilResume checks the full rotate handshake,
+// not just drainShard: once a shard has acked a rotate, it must not resume
+// consuming shardChans (and so must not route a late span back into the
+// ring slot it just closed out of) until flush() signals resume, which it
+// only does once that ring slot's merge/Encode/send have completed. This is
+// what actually closes the race drainShard alone left open: a late span
+// queued or arriving after the ack could otherwise still land in
+// c.buckets[closedIdx][shard] concurrently with flush() reading it.
+func TestShardWorkerStaysPausedUntilResume(t *testing.T) {
+	exit := make(chan bool)
+	var exitGroup sync.WaitGroup
+	c := NewConcentrator(1, 0.01, 2, 1, 10, AlgoTDigest, exit, &exitGroup)
+	c.Init(make(chan model.Span), make(chan model.Span, 1000), NullExporter{})
+	aligned := c.alignedNow()
+	c.buckets[0][0] = c.newBucket(aligned)
+	c.bucketStarts[0] = aligned
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { defer wg.Done(); c.shardWorker(0) }()
+
+	c.rotate[0] <- struct{}{}
+	<-c.rotateAck[0]
+
+	// the shard is now blocked on resume; a span landing here must not be
+	// applied until flush() says the merge of this ring slot is done.
+	c.shardChans[0] <- model.Span{Service: "web", Resource: "/", Start: aligned * int64(time.Second), Duration: 5}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.digests[0][0]["web|/"]; ok {
+		t.Fatal("expected the shard to stay paused until resume, not apply the queued span early")
+	}
+
+	c.resume[0] <- struct{}{}
+	close(c.shardChans[0]) // let shardWorker apply the queued span, then exit
+	wg.Wait()
+
+	if _, ok := c.digests[0][0]["web|/"]; !ok {
+		t.Fatal("expected the span to be applied once resume was signaled")
+	}
+}
+
+// TestDrainShardAppliesQueuedSpans checks that a span already sitting in a
+// shard's channel is applied before drainShard returns, which is what lets
+// shardWorker ack a rotate signal only once it's actually idle (the race
+// the rotate/rotateAck handshake exists to close). No shardWorker goroutine
+// is started here, so drainShard is the only thing that can process it.
+func TestDrainShardAppliesQueuedSpans(t *testing.T) {
+	exit := make(chan bool)
+	var exitGroup sync.WaitGroup
+	c := NewConcentrator(1, 0.01, 2, 1, 10, AlgoTDigest, exit, &exitGroup)
+	c.Init(make(chan model.Span), make(chan model.Span, 1000), NullExporter{})
+	aligned := c.alignedNow()
+	c.buckets[0][0] = c.newBucket(aligned)
+	c.bucketStarts[0] = aligned
+
+	c.shardChans[0] <- model.Span{Service: "web", Resource: "/", Start: aligned * int64(time.Second), Duration: 7}
+
+	c.drainShard(0)
+
+	if _, ok := c.digests[0][0]["web|/"]; !ok {
+		t.Fatal("expected drainShard to apply the span queued on the shard's channel")
+	}
+}
+
+// TestMergeDigestsCombinesShards checks that mergeDigests actually calls
+// TDigest.Merge across every shard's copy of a (service,resource) key,
+// rather than keeping only one shard's view.
+func TestMergeDigestsCombinesShards(t *testing.T) {
+	c := newTestConcentratorAlgo(2, AlgoTDigest)
+	ring := int(c.currentBucket)
+
+	d0 := NewTDigest(tdigestCompression)
+	d0.Add(10)
+	c.digests[ring][0]["web|/"] = d0
+
+	d1 := NewTDigest(tdigestCompression)
+	d1.Add(1000)
+	c.digests[ring][1]["web|/"] = d1
+
+	merged := c.mergeDigests(ring)
+	d, ok := merged["web|/"]
+	if !ok {
+		t.Fatal("expected mergeDigests to produce an entry for web|/")
+	}
+	if len(d.Centroids()) != 2 {
+		t.Fatalf("expected both shards' samples to be present after merge, got %d centroids", len(d.Centroids()))
+	}
+}
@@ -0,0 +1,244 @@
+// StatsExporter lets a Concentrator hand off flushed buckets to a
+// configurable sink instead of a raw channel, the reporter pattern tracing
+// clients already use for spans. This keeps the Concentrator testable in
+// isolation and lets operators swap sinks without touching the pipeline.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/raclette/model"
+)
+
+// defaultBackPressureTimeout is how long ChanExporter waits for its channel
+// to have room before it starts dropping buckets.
+const defaultBackPressureTimeout = 1 * time.Second
+
+// StatsExporter is the sink a Concentrator writes its flushed StatsBuckets
+// to. Report is called once per flushed bucket, from the bucketCloser
+// goroutine, so implementations that do I/O should not block it for long.
+type StatsExporter interface {
+	Report(bucket model.StatsBucket) error
+	Close() error
+}
+
+// NullExporter discards every bucket it's given, useful for tests and for
+// running the Concentrator with stats reporting disabled.
+type NullExporter struct{}
+
+// Report implements StatsExporter.
+func (NullExporter) Report(bucket model.StatsBucket) error { return nil }
+
+// Close implements StatsExporter.
+func (NullExporter) Close() error { return nil }
+
+// LoggingExporter logs a one-line summary of every bucket it's given, handy
+// when diagnosing the pipeline without a live Datadog intake.
+type LoggingExporter struct{}
+
+// Report implements StatsExporter.
+func (LoggingExporter) Report(bucket model.StatsBucket) error {
+	log.Infof("StatsExporter: flushed bucket start=%d duration=%d", bucket.Start, bucket.Duration)
+	return nil
+}
+
+// Close implements StatsExporter.
+func (LoggingExporter) Close() error { return nil }
+
+// ReportDigest implements DigestExporter.
+func (LoggingExporter) ReportDigest(key string, centroids []Centroid) error {
+	log.Infof("StatsExporter: flushed t-digest key=%s centroids=%d", key, len(centroids))
+	return nil
+}
+
+// ChanExporter forwards every bucket onto a channel, the shape the
+// Concentrator used before StatsExporter existed. It reproduces the
+// Concentrator's former back-pressure behaviour: if the channel is still
+// full after Timeout, the oldest buffered bucket is dropped to make room
+// rather than blocking forever or dropping the one just flushed.
+type ChanExporter struct {
+	Out     chan model.StatsBucket
+	Timeout time.Duration
+}
+
+// NewChanExporter returns a ChanExporter with a buffered channel of size buf.
+func NewChanExporter(buf int) *ChanExporter {
+	return &ChanExporter{Out: make(chan model.StatsBucket, buf), Timeout: defaultBackPressureTimeout}
+}
+
+// Report implements StatsExporter.
+func (e *ChanExporter) Report(bucket model.StatsBucket) error {
+	select {
+	case e.Out <- bucket:
+		return nil
+	default:
+	}
+
+	timeout := time.NewTimer(e.Timeout)
+	defer timeout.Stop()
+
+	select {
+	case e.Out <- bucket:
+		return nil
+	case <-timeout.C:
+		select {
+		case <-e.Out:
+			log.Error("ChanExporter: backed up, dropped oldest stats bucket")
+		default:
+		}
+
+		select {
+		case e.Out <- bucket:
+		default:
+			log.Error("ChanExporter: still full after dropping oldest bucket, dropping current bucket")
+		}
+		return nil
+	}
+}
+
+// Close implements StatsExporter.
+func (e *ChanExporter) Close() error {
+	close(e.Out)
+	return nil
+}
+
+// datadogWriter is the subset of the existing Datadog HTTP writer that
+// DatadogExporter needs, kept narrow so this file doesn't have to import it.
+type datadogWriter interface {
+	WriteStats(bucket model.StatsBucket)
+}
+
+// DatadogExporter reports buckets to the agent's existing Datadog HTTP
+// writer, preserving the pipeline's previous default behaviour.
+type DatadogExporter struct {
+	writer datadogWriter
+}
+
+// NewDatadogExporter returns a DatadogExporter writing through w.
+func NewDatadogExporter(w datadogWriter) *DatadogExporter {
+	return &DatadogExporter{writer: w}
+}
+
+// Report implements StatsExporter.
+func (e *DatadogExporter) Report(bucket model.StatsBucket) error {
+	e.writer.WriteStats(bucket)
+	return nil
+}
+
+// Close implements StatsExporter.
+func (e *DatadogExporter) Close() error { return nil }
+
+// BatchExporter coalesces several buckets into one HTTP POST, Jaeger/OTLP
+// batch-reporter style: it never waits past the flushInterval given to
+// NewBatchExporter to ship what it
+// has, and ships early if MaxBatchSize is reached first.
+type BatchExporter struct {
+	URL          string
+	MaxBatchSize int
+
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []model.StatsBucket
+
+	flushNow chan struct{}
+	exit     chan struct{}
+	done     chan struct{}
+}
+
+// NewBatchExporter starts a BatchExporter POSTing batched buckets to url.
+func NewBatchExporter(url string, maxBatchSize int, flushInterval time.Duration) *BatchExporter {
+	e := &BatchExporter{
+		URL:          url,
+		MaxBatchSize: maxBatchSize,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		flushNow:     make(chan struct{}, 1),
+		exit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go e.run(flushInterval)
+	return e
+}
+
+// Report implements StatsExporter. It only ever buffers: the actual POST
+// runs on run()'s goroutine, so filling a batch here can never block the
+// Concentrator's bucketCloser goroutine that calls Report.
+func (e *BatchExporter) Report(bucket model.StatsBucket) error {
+	e.mu.Lock()
+	e.pending = append(e.pending, bucket)
+	full := len(e.pending) >= e.MaxBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flushNow <- struct{}{}:
+		default:
+			// a flush is already pending, run() will pick up this bucket too
+		}
+	}
+	return nil
+}
+
+// flush POSTs and clears whatever is pending, if anything.
+func (e *BatchExporter) flush() {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Errorf("BatchExporter: failed to encode batch of %d buckets: %v", len(batch), err)
+		return
+	}
+
+	resp, err := e.client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("BatchExporter: failed to POST batch of %d buckets: %v", len(batch), err)
+		return
+	}
+	// drain before Close so the connection can be reused by client's pool,
+	// rather than leaked/reopened on every flush.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Errorf("BatchExporter: POST of batch of %d buckets got status %s", len(batch), resp.Status)
+	}
+}
+
+func (e *BatchExporter) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.flushNow:
+			e.flush()
+		case <-e.exit:
+			e.flush()
+			close(e.done)
+			return
+		}
+	}
+}
+
+// Close implements StatsExporter.
+func (e *BatchExporter) Close() error {
+	close(e.exit)
+	<-e.done
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/raclette/model"
+)
+
+// TestChanExporterReport checks the common case: a bucket is forwarded as
+// long as there's room on the channel.
+func TestChanExporterReport(t *testing.T) {
+	e := NewChanExporter(1)
+
+	if err := e.Report(model.StatsBucket{Start: 1}); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	select {
+	case b := <-e.Out:
+		if b.Start != 1 {
+			t.Fatalf("got bucket %+v, want Start=1", b)
+		}
+	default:
+		t.Fatal("expected the bucket to be forwarded")
+	}
+}
+
+// TestChanExporterDropsOldestWhenFull checks ChanExporter's back-pressure
+// behaviour: once Timeout elapses with the channel still full, it drops the
+// oldest buffered bucket to make room for the new one rather than blocking
+// forever or dropping the one just flushed.
+func TestChanExporterDropsOldestWhenFull(t *testing.T) {
+	e := NewChanExporter(1)
+	e.Timeout = 10 * time.Millisecond
+
+	e.Out <- model.StatsBucket{Start: 1} // fill the channel up front
+
+	if err := e.Report(model.StatsBucket{Start: 2}); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	got := <-e.Out
+	if got.Start != 2 {
+		t.Fatalf("got bucket Start=%d, want the newly reported bucket (Start=2) after the oldest is dropped", got.Start)
+	}
+}
+
+// TestDatadogExporterReport checks that DatadogExporter forwards the bucket
+// to its writer unchanged.
+func TestDatadogExporterReport(t *testing.T) {
+	var got model.StatsBucket
+	w := fakeDatadogWriter(func(b model.StatsBucket) { got = b })
+
+	e := NewDatadogExporter(w)
+	if err := e.Report(model.StatsBucket{Start: 42}); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if got.Start != 42 {
+		t.Fatalf("writer got Start=%d, want 42", got.Start)
+	}
+}
+
+type fakeDatadogWriter func(model.StatsBucket)
+
+func (f fakeDatadogWriter) WriteStats(b model.StatsBucket) { f(b) }
+
+// TestBatchExporterReportDoesNotBlock checks the bug this request was filed
+// over: Report must never itself perform the HTTP POST, even once a batch
+// fills up, so it can't stall the Concentrator's bucketCloser goroutine.
+func TestBatchExporterReportDoesNotBlock(t *testing.T) {
+	const postDelay = 200 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(postDelay)
+	}))
+	defer srv.Close()
+
+	e := NewBatchExporter(srv.URL, 1, time.Hour)
+	defer e.Close()
+
+	done := make(chan struct{})
+	go func() {
+		e.Report(model.StatsBucket{Start: 1}) // MaxBatchSize=1: triggers a flush
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(postDelay):
+		t.Fatal("Report blocked on the exporter's HTTP POST")
+	}
+}
+
+// TestBatchExporterFlushesOnMaxBatchSize checks that a batch is POSTed once
+// it reaches MaxBatchSize, without waiting for the flush interval.
+func TestBatchExporterFlushesOnMaxBatchSize(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	e := NewBatchExporter(srv.URL, 2, time.Hour)
+	defer e.Close()
+
+	e.Report(model.StatsBucket{Start: 1})
+	e.Report(model.StatsBucket{Start: 2})
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&requests) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("got %d POSTs, want exactly 1 once MaxBatchSize is reached", requests)
+	}
+}
+
+// TestBatchExporterCloseFlushesPending checks that Close flushes whatever is
+// still buffered rather than dropping it.
+func TestBatchExporterCloseFlushesPending(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	e := NewBatchExporter(srv.URL, 100, time.Hour)
+	e.Report(model.StatsBucket{Start: 1})
+	e.Close()
+
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("got %d POSTs, want exactly 1 on Close with a pending bucket", requests)
+	}
+}
+
+// TestBatchExporterFlushHandlesNonOKStatus checks that a non-2xx response
+// doesn't stop flush from completing: there's nothing to retry (the batch is
+// gone either way), so flush must just log it and move on rather than
+// treating the POST as if it had failed to send at all.
+func TestBatchExporterFlushHandlesNonOKStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	e := NewBatchExporter(srv.URL, 1, time.Hour)
+	e.Report(model.StatsBucket{Start: 1})
+	e.Close() // would hang or panic here if flush mishandled the non-2xx response
+}
+
+// TestBatchExporterDrainsBodyForReuse checks the other half of the bug this
+// request was filed over: flush must drain the response body before closing
+// it, or the underlying connection can never be returned to the client's
+// keep-alive pool, and a sustained flush interval leaks/reopens a new TCP
+// connection instead of reusing one.
+func TestBatchExporterDrainsBodyForReuse(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	var newConns int32
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	e := NewBatchExporter(srv.URL, 1, time.Hour)
+	defer e.Close()
+
+	for i := 0; i < 5; i++ {
+		e.Report(model.StatsBucket{Start: int64(i)})
+		time.Sleep(20 * time.Millisecond) // give run()'s goroutine time to flush before the next Report fills the batch again
+	}
+
+	if got := atomic.LoadInt32(&newConns); got > 1 {
+		t.Fatalf("got %d new connections across 5 sequential flushes, want the client to reuse one (response body wasn't drained before Close)", got)
+	}
+}
@@ -0,0 +1,278 @@
+// Sampler
+// Sits downstream of the Concentrator, on the outSpans channel, and decides
+// which full traces are worth forwarding to the writer. Stats themselves are
+// never sampled: they are computed by the Concentrator off the complete
+// stream, the Sampler only thins out the raw spans.
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/raclette/model"
+)
+
+// defaultIdleTimeout is how long we wait without seeing a new span for a
+// TraceID before considering that trace complete and flushing a sampling
+// decision for it.
+const defaultIdleTimeout = 10 * time.Second
+
+// sweepInterval is how often we scan buffered traces for ones that have
+// gone idle.
+const sweepInterval = 1 * time.Second
+
+// SamplerConfig holds the knobs of the tail-based sampling pipeline.
+//  * SampleRate, fraction (0..1) of non-priority traces kept
+//  * MaxTPS, hard cap on non-priority traces/sec forwarded downstream (priority traces bypass it), 0 disables it
+//  * IdleTimeout, time since the last span of a trace before it's considered complete
+type SamplerConfig struct {
+	SampleRate  float64
+	MaxTPS      float64
+	IdleTimeout time.Duration
+}
+
+// SamplerReport holds the kept/dropped counters for one reporting period.
+type SamplerReport struct {
+	Kept    int64
+	Dropped int64
+}
+
+// pendingTrace buffers the spans of a TraceID until it's considered complete.
+type pendingTrace struct {
+	spans    []model.Span
+	lastSeen int64
+	priority bool
+}
+
+// Sampler buffers spans by TraceID and, once a trace goes idle, decides
+// whether to forward it whole or drop it whole.
+//  * inSpans, channel we consume spans from (fed by the Concentrator's outSpans)
+//  * outSpans, channel of spans kept for the writer
+//  * conf, sampling configuration
+//  * pending, traces currently being buffered, keyed by TraceID
+//  * thresholds, per-(service,resource) p95 duration, refreshed from flushed StatsBuckets
+type Sampler struct {
+	inSpans  chan model.Span
+	outSpans chan model.Span
+
+	exit      chan bool
+	exitGroup *sync.WaitGroup
+
+	conf    SamplerConfig
+	limiter *rateLimiter
+
+	mu      sync.Mutex
+	pending map[model.TraceID]*pendingTrace
+
+	thresholdMu sync.RWMutex
+	thresholds  map[string]float64
+
+	reportMu sync.Mutex
+	report   SamplerReport
+}
+
+// NewSampler returns a new Sampler obeying conf, sharing the exit/exitGroup
+// semantics of the Concentrator so both shut down cleanly together.
+func NewSampler(conf SamplerConfig, exit chan bool, exitGroup *sync.WaitGroup) *Sampler {
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = defaultIdleTimeout
+	}
+
+	return &Sampler{
+		exit:       exit,
+		exitGroup:  exitGroup,
+		conf:       conf,
+		limiter:    newRateLimiter(conf.MaxTPS),
+		pending:    make(map[model.TraceID]*pendingTrace),
+		thresholds: make(map[string]float64),
+	}
+}
+
+// Init sets the channels for incoming and sampled-out spans before starting.
+func (s *Sampler) Init(inSpans chan model.Span, outSpans chan model.Span) {
+	s.inSpans = inSpans
+	s.outSpans = outSpans
+}
+
+// Start begins consuming spans and sweeping idle traces.
+func (s *Sampler) Start() {
+	go func() {
+		// should return when upstream span channel is closed
+		for span := range s.inSpans {
+			s.add(span)
+		}
+	}()
+
+	go s.idleSweeper()
+
+	log.Info("Sampler started")
+}
+
+// add buffers a span under its TraceID, creating the pending trace if needed.
+func (s *Sampler) add(span model.Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.pending[span.TraceID]
+	if !ok {
+		t = &pendingTrace{}
+		s.pending[span.TraceID] = t
+	}
+	t.spans = append(t.spans, span)
+	t.lastSeen = model.Now()
+	if span.Error != 0 {
+		t.priority = true
+	}
+}
+
+// UpdateThresholds refreshes the per-(service,resource) p95 duration used by
+// priority sampling, called with every bucket the Concentrator flushes.
+func (s *Sampler) UpdateThresholds(bucket model.StatsBucket) {
+	thresholds := make(map[string]float64)
+	for key, p95 := range bucket.P95s() {
+		thresholds[key] = p95
+	}
+
+	s.thresholdMu.Lock()
+	s.thresholds = thresholds
+	s.thresholdMu.Unlock()
+}
+
+// idleSweeper periodically flushes traces that have gone idle, and exits
+// cleanly, flushing everything still pending, when told to.
+func (s *Sampler) idleSweeper() {
+	s.exitGroup.Add(1)
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.exit:
+			log.Info("Sampler exiting")
+			s.sweep(true)
+			close(s.outSpans)
+			s.exitGroup.Done()
+			return
+		case <-ticker.C:
+			s.sweep(false)
+		}
+	}
+}
+
+// sweep walks pending traces and flushes a sampling decision for every one
+// that has been idle for longer than conf.IdleTimeout. If force is set, every
+// pending trace is flushed regardless of age (used on shutdown).
+func (s *Sampler) sweep(force bool) {
+	now := model.Now()
+
+	s.mu.Lock()
+	due := make([]model.TraceID, 0)
+	for id, t := range s.pending {
+		if force || now-t.lastSeen > int64(s.conf.IdleTimeout) {
+			due = append(due, id)
+		}
+	}
+	traces := make([]*pendingTrace, 0, len(due))
+	for _, id := range due {
+		traces = append(traces, s.pending[id])
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+
+	for _, t := range traces {
+		s.decide(t)
+	}
+}
+
+// decide applies priority, probabilistic sampling then rate-limiting to a
+// complete trace and forwards or drops it atomically.
+func (s *Sampler) decide(t *pendingTrace) {
+	keep := t.priority || s.exceedsThreshold(t)
+
+	if !keep {
+		// sample first so a trace SampleRate would already drop doesn't
+		// spend MaxTPS budget it was never going to use: the limiter must
+		// gate what's already passed sampling, or the forwarded rate
+		// converges to MaxTPS*SampleRate instead of the MaxTPS it promises.
+		keep = rand.Float64() < s.conf.SampleRate && s.limiter.allow()
+	}
+
+	s.reportMu.Lock()
+	if keep {
+		s.report.Kept++
+	} else {
+		s.report.Dropped++
+	}
+	s.reportMu.Unlock()
+
+	if !keep {
+		return
+	}
+	for _, span := range t.spans {
+		s.outSpans <- span
+	}
+}
+
+// exceedsThreshold reports whether any span in the trace crosses the p95
+// duration threshold recorded for its (service,resource).
+func (s *Sampler) exceedsThreshold(t *pendingTrace) bool {
+	s.thresholdMu.RLock()
+	defer s.thresholdMu.RUnlock()
+
+	for _, span := range t.spans {
+		if p95, ok := s.thresholds[span.Service+"|"+span.Resource]; ok && float64(span.Duration) > p95 {
+			return true
+		}
+	}
+	return false
+}
+
+// Report returns, and resets, the kept/dropped counters for the period since
+// the last call.
+func (s *Sampler) Report() SamplerReport {
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+
+	r := s.report
+	s.report = SamplerReport{}
+	return r
+}
+
+// rateLimiter is a simple token bucket capping decisions to maxTPS per second.
+// A zero maxTPS disables the limit entirely.
+type rateLimiter struct {
+	maxTPS float64
+
+	mu        sync.Mutex
+	tokens    float64
+	lastCheck time.Time
+}
+
+func newRateLimiter(maxTPS float64) *rateLimiter {
+	return &rateLimiter{maxTPS: maxTPS, tokens: maxTPS, lastCheck: time.Now()}
+}
+
+func (r *rateLimiter) allow() bool {
+	if r.maxTPS <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.lastCheck).Seconds() * r.maxTPS
+	if r.tokens > r.maxTPS {
+		r.tokens = r.maxTPS
+	}
+	r.lastCheck = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
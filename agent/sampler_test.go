@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/raclette/model"
+)
+
+func newTestSampler(conf SamplerConfig) *Sampler {
+	exit := make(chan bool)
+	var exitGroup sync.WaitGroup
+
+	s := NewSampler(conf, exit, &exitGroup)
+	s.Init(make(chan model.Span), make(chan model.Span, 1000))
+	return s
+}
+
+// TestSamplerKeepsErrorTraces checks that a trace carrying an errored span is
+// always forwarded, bypassing both rate-limiting and the sample rate.
+func TestSamplerKeepsErrorTraces(t *testing.T) {
+	s := newTestSampler(SamplerConfig{SampleRate: 0, MaxTPS: 0})
+
+	trace := &pendingTrace{
+		spans:    []model.Span{{TraceID: 1, Service: "web", Resource: "/", Error: 1}},
+		priority: true,
+	}
+	s.decide(trace)
+
+	select {
+	case <-s.outSpans:
+	default:
+		t.Fatal("expected the errored trace to be forwarded")
+	}
+
+	report := s.Report()
+	if report.Kept != 1 || report.Dropped != 0 {
+		t.Fatalf("expected Kept=1 Dropped=0, got %+v", report)
+	}
+}
+
+// TestSamplerDropsBelowSampleRate checks that a non-priority trace is dropped
+// when SampleRate is 0.
+func TestSamplerDropsBelowSampleRate(t *testing.T) {
+	s := newTestSampler(SamplerConfig{SampleRate: 0, MaxTPS: 0})
+
+	trace := &pendingTrace{spans: []model.Span{{TraceID: 1, Service: "web", Resource: "/"}}}
+	s.decide(trace)
+
+	select {
+	case span := <-s.outSpans:
+		t.Fatalf("expected trace to be dropped, got %+v", span)
+	default:
+	}
+
+	report := s.Report()
+	if report.Kept != 0 || report.Dropped != 1 {
+		t.Fatalf("expected Kept=0 Dropped=1, got %+v", report)
+	}
+}
+
+// TestSamplerSampleRateGatesBeforeLimiter checks that a trace dropped by
+// SampleRate never spends rate-limiter budget: the limiter must only ever
+// gate traces that already passed sampling, or the forwarded rate converges
+// to MaxTPS*SampleRate instead of the MaxTPS the config promises.
+func TestSamplerSampleRateGatesBeforeLimiter(t *testing.T) {
+	s := newTestSampler(SamplerConfig{SampleRate: 0, MaxTPS: 1})
+
+	trace := &pendingTrace{spans: []model.Span{{TraceID: 1, Service: "web", Resource: "/"}}}
+	s.decide(trace)
+
+	if !s.limiter.allow() {
+		t.Fatal("expected the limiter's single token to still be available after a SampleRate=0 drop")
+	}
+}
+
+// TestSamplerExceedsThreshold checks that a span whose duration crosses its
+// (service,resource) p95 threshold is kept regardless of sample rate.
+func TestSamplerExceedsThreshold(t *testing.T) {
+	s := newTestSampler(SamplerConfig{SampleRate: 0, MaxTPS: 0})
+	s.thresholds["web|/"] = 100
+
+	trace := &pendingTrace{spans: []model.Span{{TraceID: 1, Service: "web", Resource: "/", Duration: 200}}}
+	s.decide(trace)
+
+	select {
+	case <-s.outSpans:
+	default:
+		t.Fatal("expected the over-threshold trace to be forwarded")
+	}
+}
+
+// TestSamplerUpdateThresholds checks that thresholds are refreshed from a
+// flushed StatsBucket's P95s, replacing whatever was there before.
+func TestSamplerUpdateThresholds(t *testing.T) {
+	s := newTestSampler(SamplerConfig{})
+	s.thresholds["stale|key"] = 1
+
+	// model.StatsBucket.P95s is a stub returning nil in this tree; exercise
+	// the swap itself rather than the (external) P95 computation.
+	s.UpdateThresholds(model.StatsBucket{})
+
+	s.thresholdMu.RLock()
+	defer s.thresholdMu.RUnlock()
+	if _, ok := s.thresholds["stale|key"]; ok {
+		t.Fatal("expected UpdateThresholds to replace the threshold map, not merge into it")
+	}
+}
+
+// TestSamplerSweepFlushesIdleTraces checks that sweep only flushes traces
+// that have been idle longer than IdleTimeout, unless forced.
+func TestSamplerSweepFlushesIdleTraces(t *testing.T) {
+	s := newTestSampler(SamplerConfig{SampleRate: 1, IdleTimeout: 10 * time.Millisecond})
+
+	s.mu.Lock()
+	s.pending[1] = &pendingTrace{lastSeen: model.Now() - int64(20*time.Millisecond), spans: []model.Span{{TraceID: 1}}}
+	s.pending[2] = &pendingTrace{lastSeen: model.Now(), spans: []model.Span{{TraceID: 2}}}
+	s.mu.Unlock()
+
+	s.sweep(false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[1]; ok {
+		t.Fatal("expected the idle trace to have been swept")
+	}
+	if _, ok := s.pending[2]; !ok {
+		t.Fatal("expected the fresh trace to still be pending")
+	}
+}
+
+// TestRateLimiterAllowsUpToMaxTPS checks that the token bucket allows at most
+// maxTPS decisions in quick succession once its initial burst is spent.
+func TestRateLimiterAllowsUpToMaxTPS(t *testing.T) {
+	r := newRateLimiter(2)
+
+	if !r.allow() || !r.allow() {
+		t.Fatal("expected the initial burst of maxTPS tokens to be allowed")
+	}
+	if r.allow() {
+		t.Fatal("expected the limiter to reject once its burst is spent")
+	}
+}
+
+// TestRateLimiterDisabled checks that a zero maxTPS disables the limit.
+func TestRateLimiterDisabled(t *testing.T) {
+	r := newRateLimiter(0)
+	for i := 0; i < 1000; i++ {
+		if !r.allow() {
+			t.Fatal("expected a disabled rate limiter to always allow")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// t-digest (Dunning) approximates a distribution with a small, mergeable set
+// of weighted centroids. Compared to the GK-style sketch model.StatsBucket
+// uses by default, it gives much better tail-quantile accuracy at a fixed
+// memory budget and, critically, merges losslessly, which is what lets a
+// downstream aggregator roll up distributions from many agents.
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Centroid is one weighted point of a t-digest: a mean and the number of
+// samples it represents.
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest is a merging t-digest. Add cheaply appends a weight-1 centroid per
+// value; Compress periodically folds nearby centroids together under the
+// k-scale bound so the digest stays small; Merge combines two digests.
+type TDigest struct {
+	// Compression (delta) trades accuracy for size: larger keeps more
+	// centroids and tracks the tails more tightly.
+	Compression float64
+
+	mu        sync.Mutex
+	centroids []Centroid
+	unmerged  int
+}
+
+// NewTDigest returns an empty TDigest with the given compression (delta).
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{Compression: compression}
+}
+
+// Add inserts a weight-1 centroid for value, equivalent to StatsBucket's
+// HandleSpan for the GK sketch. It compresses periodically so the centroid
+// count doesn't grow unbounded between explicit Compress calls.
+func (t *TDigest) Add(value float64) {
+	t.mu.Lock()
+	t.centroids = append(t.centroids, Centroid{Mean: value, Weight: 1})
+	t.unmerged++
+	needsCompress := t.unmerged > len(t.centroids)/2+20
+	t.mu.Unlock()
+
+	if needsCompress {
+		t.Compress()
+	}
+}
+
+// Compress sorts centroids by mean and merges adjacent ones while cumulative
+// weight stays under the k-scale bound k(q) = delta * (asin(2q-1)/pi + 0.5),
+// the construction that keeps bins tiny near q=0/q=1 and wide around the
+// median, equivalent to StatsBucket's Encode for the GK sketch.
+func (t *TDigest) Compress() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.centroids = compress(t.centroids, t.Compression)
+	t.unmerged = 0
+}
+
+func compress(centroids []Centroid, compression float64) []Centroid {
+	if len(centroids) == 0 {
+		return centroids
+	}
+
+	sorted := make([]Centroid, len(centroids))
+	copy(sorted, centroids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Mean < sorted[j].Mean })
+
+	total := 0.0
+	for _, c := range sorted {
+		total += c.Weight
+	}
+
+	merged := make([]Centroid, 0, len(sorted))
+	cur := sorted[0]
+	cumulative := 0.0
+
+	for _, c := range sorted[1:] {
+		q0 := cumulative / total
+		q1 := (cumulative + cur.Weight + c.Weight) / total
+		if kScale(q1, compression)-kScale(q0, compression) <= 1 {
+			// still within the same bin, fold it in
+			cur.Mean = (cur.Mean*cur.Weight + c.Mean*c.Weight) / (cur.Weight + c.Weight)
+			cur.Weight += c.Weight
+			continue
+		}
+		cumulative += cur.Weight
+		merged = append(merged, cur)
+		cur = c
+	}
+	merged = append(merged, cur)
+
+	return merged
+}
+
+// kScale is k(q) = delta * (asin(2q-1)/pi + 0.5).
+func kScale(q, compression float64) float64 {
+	return compression * (math.Asin(2*q-1)/math.Pi + 0.5)
+}
+
+// Merge folds other's centroids into t and re-compresses. Unlike the GK
+// sketch, this loses no more accuracy than either digest already carries,
+// which is what allows combining per-agent digests into a global one.
+func (t *TDigest) Merge(other *TDigest) {
+	other.mu.Lock()
+	add := make([]Centroid, len(other.centroids))
+	copy(add, other.centroids)
+	other.mu.Unlock()
+
+	t.mu.Lock()
+	t.centroids = append(t.centroids, add...)
+	t.mu.Unlock()
+
+	t.Compress()
+}
+
+// Quantile approximates the qth quantile (0..1) by walking centroids in
+// mean order until the cumulative weight reaches q.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.centroids) == 0 {
+		return 0
+	}
+
+	sorted := make([]Centroid, len(t.centroids))
+	copy(sorted, t.centroids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Mean < sorted[j].Mean })
+
+	total := 0.0
+	for _, c := range sorted {
+		total += c.Weight
+	}
+
+	target := q * total
+	cumulative := 0.0
+	for _, c := range sorted {
+		cumulative += c.Weight
+		if cumulative >= target {
+			return c.Mean
+		}
+	}
+	return sorted[len(sorted)-1].Mean
+}
+
+// Centroids returns a copy of the current centroids, the []{mean, weight}
+// form a StatsBucket would serialize on Encode.
+func (t *TDigest) Centroids() []Centroid {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Centroid, len(t.centroids))
+	copy(out, t.centroids)
+	return out
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestKScaleMonotonic checks that kScale is monotonically increasing in q,
+// the property compress relies on to bound adjacent centroids to the same
+// bin only while they're close in quantile space.
+func TestKScaleMonotonic(t *testing.T) {
+	prev := kScale(0.001, 100)
+	for _, q := range []float64{0.1, 0.25, 0.5, 0.75, 0.9, 0.999} {
+		cur := kScale(q, 100)
+		if cur <= prev {
+			t.Fatalf("kScale(%v) = %v, want > kScale of the previous, smaller q (%v)", q, cur, prev)
+		}
+		prev = cur
+	}
+}
+
+// TestKScaleSymmetric checks that kScale is symmetric around q=0.5, which is
+// what makes compress keep bins equally tight in both tails.
+func TestKScaleSymmetric(t *testing.T) {
+	for _, q := range []float64{0.1, 0.25, 0.4} {
+		lo := kScale(q, 100)
+		hi := kScale(1-q, 100)
+		if math.Abs((kScale(0.5, 100)-lo)-(hi-kScale(0.5, 100))) > 1e-9 {
+			t.Fatalf("kScale(%v) and kScale(%v) aren't symmetric around q=0.5: %v vs %v", q, 1-q, lo, hi)
+		}
+	}
+}
+
+// TestCompressPreservesTotalWeight checks that folding centroids together
+// never loses or fabricates samples.
+func TestCompressPreservesTotalWeight(t *testing.T) {
+	var centroids []Centroid
+	for i := 1; i <= 1000; i++ {
+		centroids = append(centroids, Centroid{Mean: float64(i), Weight: 1})
+	}
+
+	merged := compress(centroids, 20)
+
+	var total float64
+	for _, c := range merged {
+		total += c.Weight
+	}
+	if total != 1000 {
+		t.Fatalf("total weight after compress = %v, want 1000", total)
+	}
+	if len(merged) >= len(centroids) {
+		t.Fatalf("expected compress to reduce the centroid count, got %d from %d", len(merged), len(centroids))
+	}
+}
+
+// TestCompressIsSorted checks that compress always returns centroids in
+// non-decreasing mean order, whatever order its input centroids came in.
+func TestCompressIsSorted(t *testing.T) {
+	centroids := []Centroid{{Mean: 5, Weight: 1}, {Mean: 1, Weight: 1}, {Mean: 3, Weight: 1}}
+	merged := compress(centroids, 100)
+
+	for i := 1; i < len(merged); i++ {
+		if merged[i].Mean < merged[i-1].Mean {
+			t.Fatalf("compress returned unsorted centroids: %+v", merged)
+		}
+	}
+}
+
+// TestTDigestQuantileAccuracy checks that Quantile stays close to the true
+// value for a uniform distribution, the basic accuracy guarantee that makes
+// a t-digest worth its compression cost.
+func TestTDigestQuantileAccuracy(t *testing.T) {
+	d := NewTDigest(100)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+	d.Compress()
+
+	cases := []struct {
+		q    float64
+		want float64
+	}{
+		{0.5, 500},
+		{0.95, 950},
+		{0.99, 990},
+	}
+	for _, c := range cases {
+		got := d.Quantile(c.q)
+		if math.Abs(got-c.want) > 30 {
+			t.Fatalf("Quantile(%v) = %v, want close to %v", c.q, got, c.want)
+		}
+	}
+}
+
+// TestTDigestQuantileEmpty checks that an empty digest returns 0 rather than
+// panicking or indexing out of range.
+func TestTDigestQuantileEmpty(t *testing.T) {
+	d := NewTDigest(100)
+	if got := d.Quantile(0.5); got != 0 {
+		t.Fatalf("Quantile on an empty digest = %v, want 0", got)
+	}
+}
+
+// TestTDigestMerge checks that merging two digests covering disjoint ranges
+// produces a combined digest whose median reflects both halves, not just
+// one of them.
+func TestTDigestMerge(t *testing.T) {
+	a := NewTDigest(100)
+	for i := 1; i <= 1000; i++ {
+		a.Add(float64(i))
+	}
+	b := NewTDigest(100)
+	for i := 1001; i <= 2000; i++ {
+		b.Add(float64(i))
+	}
+
+	a.Merge(b)
+
+	got := a.Quantile(0.5)
+	if math.Abs(got-1000) > 60 {
+		t.Fatalf("merged median = %v, want close to 1000", got)
+	}
+}
+
+// TestTDigestCentroidsIsACopy checks that Centroids returns a snapshot, not
+// a view backed by the digest's own slice, so a caller (e.g. an exporter)
+// can't race with further Adds.
+func TestTDigestCentroidsIsACopy(t *testing.T) {
+	d := NewTDigest(100)
+	d.Add(1)
+
+	centroids := d.Centroids()
+	centroids[0].Mean = 999
+
+	if got := d.Quantile(1); got == 999 {
+		t.Fatal("Centroids returned a slice aliasing the digest's internal state")
+	}
+}